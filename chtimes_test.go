@@ -0,0 +1,69 @@
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestChtimesSymlink(t *testing.T) {
+	dir := t.TempDir()
+
+	target := filepath.Join(dir, "target")
+	if err := os.WriteFile(target, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+
+	want := time.Unix(1000000000, 0)
+	if err := Chtimes(link, want, want); err != nil {
+		t.Fatal(err)
+	}
+
+	linkInfo, err := os.Lstat(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !linkInfo.ModTime().Equal(want) {
+		t.Errorf("link mtime = %v, want %v", linkInfo.ModTime(), want)
+	}
+
+	targetInfo, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if targetInfo.ModTime().Equal(want) {
+		t.Errorf("target mtime changed, want the symlink itself to be retimed, not its target")
+	}
+}
+
+func BenchmarkChtimes10kFiles(b *testing.B) {
+	dir := b.TempDir()
+
+	const n = 10000
+	paths := make([]string, n)
+	for i := range paths {
+		path := filepath.Join(dir, "file"+strconv.Itoa(i))
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			b.Fatal(err)
+		}
+		paths[i] = path
+	}
+
+	mtime := time.Unix(1000000000, 0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, path := range paths {
+			if err := Chtimes(path, mtime, mtime); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package git
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Chtimes changes the access and modification time of path, matching
+// symlink semantics of `touch -h`: if path is a symlink, the link itself is
+// retimed rather than the file it points at.
+func Chtimes(path string, atime, mtime time.Time) error {
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(mtime.UnixNano()),
+	}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "utimesnanoat", Path: path, Err: err}
+	}
+	return nil
+}
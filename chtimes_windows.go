@@ -0,0 +1,37 @@
+package git
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// Chtimes changes the access and modification time of path. The handle is
+// opened with FILE_FLAG_OPEN_REPARSE_POINT so that, like `touch -h` on
+// Unix, a symlink's own timestamps are set rather than its target's.
+func Chtimes(path string, atime, mtime time.Time) error {
+	pathp, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return &os.PathError{Op: "chtimes", Path: path, Err: err}
+	}
+
+	handle, err := syscall.CreateFile(
+		pathp,
+		syscall.FILE_WRITE_ATTRIBUTES,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil,
+		syscall.OPEN_EXISTING,
+		syscall.FILE_FLAG_BACKUP_SEMANTICS|syscall.FILE_FLAG_OPEN_REPARSE_POINT,
+		0)
+	if err != nil {
+		return &os.PathError{Op: "CreateFile", Path: path, Err: err}
+	}
+	defer syscall.CloseHandle(handle)
+
+	a := syscall.NsecToFiletime(atime.UnixNano())
+	m := syscall.NsecToFiletime(mtime.UnixNano())
+	if err := syscall.SetFileTime(handle, nil, &a, &m); err != nil {
+		return &os.PathError{Op: "SetFileTime", Path: path, Err: err}
+	}
+	return nil
+}
@@ -1,14 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"os"
+	"net/http"
 	"time"
 
 	"github.com/sensiblecodeio/git-prep-directory"
+	"github.com/sensiblecodeio/git-prep-directory/gitserver"
 
-	"github.com/codegangsta/cli"
+	"github.com/urfave/cli"
 )
 
 // CloneTimeout specifies the duration allowed for each individual `git clone`
@@ -32,11 +34,11 @@ func main() {
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:  "url, u",
-			Usage: "URL to clone",
+			Usage: "URL to clone, optionally as \"url#ref:subdir\" (--ref wins if also given)",
 		},
 		cli.StringFlag{
 			Name:  "ref, r",
-			Usage: "ref to checkout",
+			Usage: "ref to checkout; overrides any ref given via --url's #fragment",
 		},
 		cli.StringFlag{
 			Name:  "destination, d",
@@ -49,14 +51,89 @@ func main() {
 			Value:  CloneTimeout,
 			EnvVar: "GIT_PREP_DIR_TIMEOUT",
 		},
+		cli.IntFlag{
+			Name:  "depth",
+			Usage: "shallow-clone the mirror to this many commits (0 for full history)",
+		},
+		cli.StringFlag{
+			Name:  "filter",
+			Usage: "partial-clone filter, e.g. \"blob:none\" (requires a git server that supports it)",
+		},
+		cli.StringFlag{
+			Name:  "http-proxy",
+			Usage: "proxy to use for http:// remotes",
+		},
+		cli.StringFlag{
+			Name:  "https-proxy",
+			Usage: "proxy to use for https:// remotes",
+		},
+		cli.StringFlag{
+			Name:  "no-proxy",
+			Usage: "comma-separated hosts to exclude from http-proxy/https-proxy",
+		},
+		cli.StringFlag{
+			Name:  "ssh-command",
+			Usage: "command to use in place of ssh, e.g. to point at a deploy key",
+		},
+		cli.StringFlag{
+			Name:  "credential-helper",
+			Usage: "git credential helper to use for authenticating to url, e.g. \"store\"",
+		},
+	}
+
+	app.Commands = []cli.Command{
+		{
+			Name:  "serve",
+			Usage: "run a long-lived HTTP service exposing tarballs of configured repos",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config, c",
+					Usage: "path to a JSON config file listing repos to mirror",
+				},
+				cli.StringFlag{
+					Name:  "mirror-root",
+					Usage: "directory to store mirrors and archive cache under",
+					Value: "./mirrors",
+				},
+				cli.DurationFlag{
+					Name:  "poll",
+					Usage: "interval to re-fetch each mirrored repo",
+					Value: 1 * time.Minute,
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Usage: "budget for each git clone/fetch/checkout/metadata operation (unrelated to --poll)",
+					Value: CloneTimeout,
+				},
+				cli.StringFlag{
+					Name:  "addr",
+					Usage: "address to listen on",
+					Value: ":8080",
+				},
+			},
+			Action: actionServe,
+		},
 	}
 
 	app.RunAndExitOnError()
 }
 
 func actionMain(c *cli.Context) {
-	if !c.GlobalIsSet("url") || !c.GlobalIsSet("ref") {
-		log.Fatalln("Error: --url and --ref required")
+	if !c.GlobalIsSet("url") {
+		log.Fatalln("Error: --url required")
+	}
+
+	opts := git.CloneOptions{
+		Depth:  c.GlobalInt("depth"),
+		Filter: c.GlobalString("filter"),
+	}
+
+	env := git.GitEnv{
+		HTTPProxy:        c.GlobalString("http-proxy"),
+		HTTPSProxy:       c.GlobalString("https-proxy"),
+		NoProxy:          c.GlobalString("no-proxy"),
+		SSHCommand:       c.GlobalString("ssh-command"),
+		CredentialHelper: c.GlobalString("credential-helper"),
 	}
 
 	where, err := git.PrepBuildDirectory(
@@ -64,10 +141,37 @@ func actionMain(c *cli.Context) {
 		c.GlobalString("url"),
 		c.GlobalString("ref"),
 		c.GlobalDuration("timeout"),
-		os.Stderr)
+		opts,
+		env)
 	if err != nil {
 		log.Fatalln("Error:", err)
 	}
 	log.Printf("Checked out %v at %v", where.Name, where.Dir)
 	fmt.Println(where.Dir)
 }
+
+func actionServe(c *cli.Context) {
+	if !c.IsSet("config") {
+		log.Fatalln("Error: --config required")
+	}
+
+	cfg, err := gitserver.LoadConfig(c.String("config"))
+	if err != nil {
+		log.Fatalln("Error:", err)
+	}
+
+	srv, err := gitserver.NewServer(cfg, c.String("mirror-root"), c.Duration("poll"), git.UniformTimeouts(c.Duration("timeout")))
+	if err != nil {
+		log.Fatalln("Error:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := srv.Start(ctx); err != nil {
+		log.Fatalln("Error:", err)
+	}
+
+	log.Printf("Listening on %v", c.String("addr"))
+	log.Fatalln(http.ListenAndServe(c.String("addr"), srv.Handler()))
+}
@@ -0,0 +1,79 @@
+package git
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+)
+
+// GitEnv tunes how git reaches a remote: which proxy to go through, what SSH
+// command to invoke, and how to authenticate. The zero value runs git with
+// no extra tuning, relying on whatever is already configured globally (or
+// not at all, which is fine for public repos on a machine with no proxy).
+type GitEnv struct {
+	HTTPProxy        string            `json:"httpProxy,omitempty"`
+	HTTPSProxy       string            `json:"httpsProxy,omitempty"`
+	NoProxy          string            `json:"noProxy,omitempty"`
+	SSHCommand       string            `json:"sshCommand,omitempty"`
+	CredentialHelper string            `json:"credentialHelper,omitempty"`
+	ExtraConfig      map[string]string `json:"extraConfig,omitempty"`
+}
+
+// configArgs returns the `-c key=value` flags implied by env, in a stable
+// order, meant to be placed ahead of the git subcommand. HTTPProxy and
+// HTTPSProxy are deliberately not among them: git has no "https.proxy" key
+// (https.* only holds TLS settings), and a single "http.proxy" can't carry
+// two different proxies for two different schemes, so those two are
+// applied via HTTP_PROXY/HTTPS_PROXY in environ instead, same as NoProxy.
+func (env GitEnv) configArgs() []string {
+	var args []string
+	add := func(key, val string) {
+		if val != "" {
+			args = append(args, "-c", key+"="+val)
+		}
+	}
+	add("core.sshCommand", env.SSHCommand)
+	add("credential.helper", env.CredentialHelper)
+
+	keys := make([]string, 0, len(env.ExtraConfig))
+	for k := range env.ExtraConfig {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		add(k, env.ExtraConfig[k])
+	}
+	return args
+}
+
+// environ returns the environment to run git under, or nil to inherit the
+// current process's unchanged. HTTPProxy, HTTPSProxy and NoProxy all travel
+// this way rather than as `-c` flags, since they're consulted by git's HTTP
+// transport (via curl conventions) per-scheme as HTTP_PROXY/HTTPS_PROXY/
+// NO_PROXY, with no single git config key able to express the same thing.
+func (env GitEnv) environ() []string {
+	if env.HTTPProxy == "" && env.HTTPSProxy == "" && env.NoProxy == "" {
+		return nil
+	}
+
+	environ := os.Environ()
+	add := func(key, val string) {
+		if val != "" {
+			environ = append(environ, key+"="+val, strings.ToLower(key)+"="+val)
+		}
+	}
+	add("HTTP_PROXY", env.HTTPProxy)
+	add("HTTPS_PROXY", env.HTTPSProxy)
+	add("NO_PROXY", env.NoProxy)
+	return environ
+}
+
+// IsRepoURLAccessible runs a fast `git ls-remote` preflight check against
+// url, mirroring the approach Gitea's remote-repo validation uses. It's
+// meant for callers like gitserver to catch a misconfigured or inaccessible
+// private repo at startup, rather than on the first clone.
+func IsRepoURLAccessible(ctx context.Context, url string, env GitEnv) bool {
+	_, err := gitOutput(ctx, ".", []string{"ls-remote", "-q", "-h", url, "HEAD"}, nil, env)
+	return err == nil
+}
@@ -0,0 +1,73 @@
+package git
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGitEnvConfigArgs(t *testing.T) {
+	env := GitEnv{
+		// HTTPProxy/HTTPSProxy/NoProxy must NOT show up here: git has no
+		// "https.proxy" config key, and a single "http.proxy" can't carry
+		// two different proxies for two different schemes. They belong in
+		// environ instead (see TestGitEnvEnviron).
+		HTTPProxy:        "http://proxy.example.com:8080",
+		HTTPSProxy:       "http://proxy.example.com:8443",
+		NoProxy:          "localhost,.internal",
+		SSHCommand:       "ssh -i /keys/deploy",
+		CredentialHelper: "store",
+		ExtraConfig:      map[string]string{"b.key": "2", "a.key": "1"},
+	}
+
+	got := env.configArgs()
+	want := []string{
+		"-c", "core.sshCommand=ssh -i /keys/deploy",
+		"-c", "credential.helper=store",
+		"-c", "a.key=1",
+		"-c", "b.key=2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("configArgs() = %q, want %q", got, want)
+	}
+}
+
+func TestGitEnvConfigArgsEmpty(t *testing.T) {
+	if got := (GitEnv{}).configArgs(); got != nil {
+		t.Errorf("configArgs() on zero value = %q, want nil", got)
+	}
+}
+
+func TestGitEnvEnviron(t *testing.T) {
+	env := GitEnv{
+		HTTPProxy:  "http://proxy.example.com:8080",
+		HTTPSProxy: "http://proxy.example.com:8443",
+		NoProxy:    "localhost",
+	}
+
+	environ := env.environ()
+	for _, want := range []string{
+		"HTTP_PROXY=http://proxy.example.com:8080",
+		"http_proxy=http://proxy.example.com:8080",
+		"HTTPS_PROXY=http://proxy.example.com:8443",
+		"https_proxy=http://proxy.example.com:8443",
+		"NO_PROXY=localhost",
+		"no_proxy=localhost",
+	} {
+		found := false
+		for _, e := range environ {
+			if e == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("environ() missing %q", want)
+		}
+	}
+}
+
+func TestGitEnvEnvironEmpty(t *testing.T) {
+	if got := (GitEnv{}).environ(); got != nil {
+		t.Errorf("environ() on zero value = %q, want nil", got)
+	}
+}
@@ -1,6 +1,7 @@
 package git
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -18,35 +19,55 @@ type BuildDirectory struct {
 	Cleanup func()
 }
 
-// PrepBuildDirectory clones a given repository and checks out the given
-// revision, setting the timestamp of all files to their commit time and putting
-// all submodules into a submodule cache.
-func PrepBuildDirectory(gitDir, remote, ref string, timeout time.Duration) (*BuildDirectory, error) {
+// PrepBuildDirectoryContext clones a given repository and checks out the
+// given revision, setting the timestamp of all files to their commit time
+// and putting all submodules into a submodule cache. opts controls whether
+// the mirror (and any submodules) are fetched shallow or with a
+// partial-clone filter; see CloneOptions. timeouts bounds each underlying
+// git invocation independently.
+//
+// remote may use the "url#ref:subdir" fragment syntax understood by
+// ParseGitRef in place of separate url/ref arguments; if ref is also given
+// explicitly, it takes precedence over any ref found in remote's fragment.
+// If a subdir is present, the returned BuildDirectory.Dir points inside the
+// checkout at that subdir.
+//
+// env supplies whatever proxy, SSH or credential helper settings remote
+// needs to be reachable; see GitEnv.
+func PrepBuildDirectoryContext(ctx context.Context, gitDir, remote, ref string, opts CloneOptions, env GitEnv, timeouts Timeouts) (*BuildDirectory, error) {
 	start := time.Now()
 	defer func() {
 		log.Printf("Took %v to prep %v", time.Since(start), remote)
 	}()
 
+	remote, fragRef, subdir, err := ParseGitRef(remote)
+	if err != nil {
+		return nil, fmt.Errorf("ParseGitRef: %v", err)
+	}
+	if ref == "" {
+		ref = fragRef
+	}
+
 	if strings.HasPrefix(remote, "github.com/") {
 		remote = "https://" + remote
 	}
 
-	gitDir, err := filepath.Abs(gitDir)
+	gitDir, err = filepath.Abs(gitDir)
 	if err != nil {
 		return nil, fmt.Errorf("unable to determine abspath: %v", err)
 	}
 
-	err = LocalMirror(remote, gitDir, ref, timeout, os.Stderr)
+	err = LocalMirrorContext(ctx, remote, gitDir, ref, os.Stderr, opts, env, timeouts)
 	if err != nil {
 		return nil, fmt.Errorf("unable to LocalMirror: %v", err)
 	}
 
-	rev, err := RevParse(gitDir, ref)
+	rev, err := RevParseContext(ctx, gitDir, ref, timeouts)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse rev: %v", err)
 	}
 
-	tagName, err := Describe(gitDir, rev)
+	tagName, err := DescribeContext(ctx, gitDir, rev, timeouts)
 	if err != nil {
 		return nil, fmt.Errorf("unable to describe %v: %v", rev, err)
 	}
@@ -54,11 +75,16 @@ func PrepBuildDirectory(gitDir, remote, ref string, timeout time.Duration) (*Bui
 	shortRev := rev[:10]
 	checkoutPath := path.Join(gitDir, filepath.Join("c/", shortRev))
 
-	err = RecursiveCheckout(gitDir, checkoutPath, rev, timeout)
+	err = RecursiveCheckoutContext(ctx, gitDir, checkoutPath, rev, os.Stderr, opts, env, timeouts)
 	if err != nil {
 		return nil, err
 	}
 
+	dir := checkoutPath
+	if subdir != "" {
+		dir = filepath.Join(checkoutPath, subdir)
+	}
+
 	cleanup := func() {
 		err := SafeCleanup(checkoutPath)
 		if err != nil {
@@ -66,7 +92,15 @@ func PrepBuildDirectory(gitDir, remote, ref string, timeout time.Duration) (*Bui
 		}
 	}
 
-	return &BuildDirectory{tagName, checkoutPath, cleanup}, nil
+	return &BuildDirectory{tagName, dir, cleanup}, nil
+}
+
+// PrepBuildDirectory is the Context-less form of PrepBuildDirectoryContext,
+// applying timeout uniformly to every underlying git invocation.
+func PrepBuildDirectory(gitDir, remote, ref string, timeout time.Duration, opts CloneOptions, env GitEnv) (*BuildDirectory, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return PrepBuildDirectoryContext(ctx, gitDir, remote, ref, opts, env, UniformTimeouts(timeout))
 }
 
 // SafeCleanup recursively removes all files from a given path, which has to be
@@ -2,22 +2,58 @@ package git
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// LocalMirror creates or updates a mirror of `url` at `gitDir` using `git clone
-// --mirror`.
-func LocalMirror(url, gitDir, ref string, timeout time.Duration, messages io.Writer) error {
-	ctx, done := context.WithTimeout(context.Background(), timeout)
-	defer done()
+// CloneOptions controls how deep a clone/fetch goes. The zero value requests
+// a full, unfiltered clone.
+//
+// Depth and Filter trade history for speed, exactly like Docker's build
+// context preparation: a shallow or blob-filtered mirror fetches much
+// faster, but SetMTimes can no longer walk `git log` to find the commit
+// that most recently touched each file, since that history isn't present.
+// When history is missing, every tracked file is instead stamped with the
+// time of the single commit that is available, which is coarser than the
+// normal per-file mtimes but still monotonic across rebuilds of the same
+// commit. Setting PromoteOnMtime fetches the missing history on demand
+// (`git fetch --unshallow`) the first time SetMTimes needs it, trading that
+// one-time cost for accurate per-file mtimes from then on.
+type CloneOptions struct {
+	Depth          int
+	Filter         string // e.g. "blob:none"
+	SingleBranch   bool
+	PromoteOnMtime bool
+}
+
+// args returns the `git clone`/`git fetch` flags implied by opts.
+func (opts CloneOptions) args() []string {
+	var args []string
+	if opts.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(opts.Depth))
+	}
+	if opts.Filter != "" {
+		args = append(args, "--filter="+opts.Filter)
+	}
+	if opts.SingleBranch {
+		args = append(args, "--single-branch")
+	}
+	return args
+}
 
+// LocalMirrorContext creates or updates a mirror of `url` at `gitDir` using
+// `git clone --mirror`, bounding each step by the relevant entry of timeouts
+// rather than ctx's deadline alone. env supplies the proxy/SSH/credential
+// settings needed to reach url, if it's private or behind a proxy.
+func LocalMirrorContext(ctx context.Context, url, gitDir, ref string, messages io.Writer, opts CloneOptions, env GitEnv, timeouts Timeouts) error {
 	if _, err := os.Stat(gitDir); err == nil {
 		// Repo already exists, don't need to clone it.
 
@@ -27,7 +63,7 @@ func LocalMirror(url, gitDir, ref string, timeout time.Duration, messages io.Wri
 			return nil
 		}
 
-		return Fetch(ctx, gitDir, url, messages)
+		return FetchContext(ctx, gitDir, url, messages, opts, env, timeouts)
 	}
 
 	err := os.MkdirAll(filepath.Dir(gitDir), 0777)
@@ -35,58 +71,109 @@ func LocalMirror(url, gitDir, ref string, timeout time.Duration, messages io.Wri
 		return err
 	}
 
-	return Clone(ctx, url, gitDir, messages)
+	return CloneContext(ctx, url, gitDir, messages, opts, env, timeouts)
 }
 
-// Clone clones a git repository as mirror.
-func Clone(ctx context.Context, url, gitDir string, messages io.Writer) error {
-	cmd := Command(".", "git", "clone", "-q", "--mirror", url, gitDir)
-	cmd.Stdout = messages
-	cmd.Stderr = messages
-	return ContextRun(ctx, cmd)
+// LocalMirror is the Context-less form of LocalMirrorContext, kept for
+// callers that haven't migrated: it applies timeout uniformly to every step
+// instead of budgeting them independently.
+func LocalMirror(url, gitDir, ref string, timeout time.Duration, messages io.Writer, opts CloneOptions, env GitEnv) error {
+	ctx, done := context.WithTimeout(context.Background(), timeout)
+	defer done()
+	return LocalMirrorContext(ctx, url, gitDir, ref, messages, opts, env, UniformTimeouts(timeout))
 }
 
-// Checkout switches branches or restores working tree files.
-func Checkout(gitDir, checkoutDir, ref string) error {
-	err := os.MkdirAll(checkoutDir, 0777)
-	if err != nil {
+// CloneContext clones a git repository as mirror, bounded by
+// timeouts.Clone.
+func CloneContext(ctx context.Context, url, gitDir string, messages io.Writer, opts CloneOptions, env GitEnv, timeouts Timeouts) error {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Clone)
+	defer cancel()
+
+	args := append([]string{"clone", "-q", "--mirror"}, opts.args()...)
+	args = append(args, url, gitDir)
+
+	_, err := gitOutput(ctx, ".", args, messages, env)
+	return err
+}
+
+// Clone is the Context-less form of CloneContext, using DefaultTimeouts.
+func Clone(ctx context.Context, url, gitDir string, messages io.Writer, opts CloneOptions, env GitEnv) error {
+	return CloneContext(ctx, url, gitDir, messages, opts, env, DefaultTimeouts)
+}
+
+// CheckoutContext switches branches or restores working tree files,
+// bounded by timeouts.Checkout. env is only consulted if gitDir needs to
+// unshallow against its remote to compute accurate mtimes; see SetMTimes.
+func CheckoutContext(ctx context.Context, gitDir, checkoutDir, ref string, opts CloneOptions, env GitEnv, timeouts Timeouts) error {
+	if err := os.MkdirAll(checkoutDir, 0777); err != nil {
 		return err
 	}
 
+	checkoutCtx, cancel := context.WithTimeout(ctx, timeouts.Checkout)
+	defer cancel()
+
 	args := []string{"--work-tree", checkoutDir, "checkout", ref, "--", "."}
-	err = Command(gitDir, "git", args...).Run()
-	if err != nil {
+	if _, err := gitOutput(checkoutCtx, gitDir, args, nil, GitEnv{}); err != nil {
 		return err
 	}
 
 	// Set mtimes to time file is most recently affected by a commit.
 	// This is annoying but unfortunately git sets the timestamps to now,
 	// and docker depends on the mtime for cache invalidation.
-	err = SetMTimes(gitDir, checkoutDir, ref)
-	if err != nil {
-		return err
-	}
+	return SetMTimes(ctx, gitDir, checkoutDir, ref, opts, env, timeouts)
+}
 
-	return nil
+// Checkout is the Context-less form of CheckoutContext, using
+// DefaultTimeouts.
+func Checkout(gitDir, checkoutDir, ref string, opts CloneOptions, env GitEnv) error {
+	return CheckoutContext(context.Background(), gitDir, checkoutDir, ref, opts, env, DefaultTimeouts)
 }
 
-// Fetch fetches all branches from a given remote.
-func Fetch(ctx context.Context, gitDir, url string, messages io.Writer) error {
-	cmd := Command(gitDir, "git", "fetch", "-f", url, "*:*")
-	cmd.Stdout = messages
-	cmd.Stderr = messages
+// FetchContext fetches all branches from a given remote, bounded by
+// timeouts.Fetch.
+func FetchContext(ctx context.Context, gitDir, url string, messages io.Writer, opts CloneOptions, env GitEnv, timeouts Timeouts) error {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Fetch)
+	defer cancel()
+
+	args := append([]string{"fetch", "-f"}, opts.args()...)
+	args = append(args, url, "*:*")
 
-	err := ContextRun(ctx, cmd)
+	_, err := gitOutput(ctx, gitDir, args, messages, env)
 	if err != nil {
+		var gitErr *GitError
 		// git fetch where there is no update is exit status 1.
-		if err.Error() != "exit status 1" {
-			return err
+		if errors.As(err, &gitErr) && gitErr.ExitCode == 1 {
+			return nil
 		}
+		return err
 	}
 
 	return nil
 }
 
+// Fetch is the Context-less form of FetchContext, using DefaultTimeouts.
+func Fetch(ctx context.Context, gitDir, url string, messages io.Writer, opts CloneOptions, env GitEnv) error {
+	return FetchContext(ctx, gitDir, url, messages, opts, env, DefaultTimeouts)
+}
+
+// Unshallow fetches the remaining history of a shallow or partial mirror
+// from its configured remote, so that subsequent calls to SetMTimes can
+// resolve accurate per-file commit times again.
+func Unshallow(ctx context.Context, gitDir string, messages io.Writer, env GitEnv) error {
+	_, err := gitOutput(ctx, gitDir, []string{"fetch", "--unshallow"}, messages, env)
+	return err
+}
+
+// IsShallow reports whether gitDir is a shallow (or partial-clone-filtered)
+// repository lacking full history.
+func IsShallow(ctx context.Context, gitDir string) (bool, error) {
+	out, err := gitOutput(ctx, gitDir, []string{"rev-parse", "--is-shallow-repository"}, nil, GitEnv{})
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(out)) == "true", nil
+}
+
 // ShaLike specifies a valid git hash.
 var ShaLike = regexp.MustCompile("[0-9a-zA-Z]{40}")
 
@@ -97,7 +184,7 @@ func AlreadyHaveRef(gitDir, sha string) bool {
 	if !ShaLike.MatchString(sha) {
 		return false
 	}
-	cmd := Command(gitDir, "git", "cat-file", "-t", sha)
+	cmd := Command(gitDir, GitEnv{}, "git", "cat-file", "-t", sha)
 	cmd.Stdout = nil
 	cmd.Stderr = nil
 
@@ -107,76 +194,120 @@ func AlreadyHaveRef(gitDir, sha string) bool {
 
 // HaveFile checks if a git directory has files checked out.
 func HaveFile(gitDir, ref, path string) (ok bool, err error) {
-	cmd := Command(gitDir, "git", "show", fmt.Sprintf("%s:%s", ref, path))
-	cmd.Stdout = nil // don't want to see the contents
-	err = cmd.Run()
-	ok = true
+	_, err = gitOutput(context.Background(), gitDir, []string{"show", fmt.Sprintf("%s:%s", ref, path)}, nil, GitEnv{})
+	if err == nil {
+		return true, nil
+	}
+
+	var gitErr *GitError
+	if errors.As(err, &gitErr) && gitErr.ExitCode == 128 {
+		// This happens if the file doesn't exist.
+		return false, nil
+	}
+	return false, err
+}
+
+// RevParseContext parses and formats the git rev of a given git reference,
+// bounded by timeouts.RevParse.
+func RevParseContext(ctx context.Context, gitDir, ref string, timeouts Timeouts) (sha string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.RevParse)
+	defer cancel()
+
+	out, err := gitOutput(ctx, gitDir, []string{"rev-parse", ref}, nil, GitEnv{})
 	if err != nil {
-		ok = false
-		if err.Error() == "exit status 128" {
-			// This happens if the file doesn't exist.
-			err = nil
-		}
+		return "", err
 	}
-	return ok, err
+	return strings.TrimSpace(string(out)), nil
 }
 
-// RevParse parses and formats the git rev of a given git reference.
+// RevParse is the Context-less form of RevParseContext, using
+// DefaultTimeouts.
 func RevParse(gitDir, ref string) (sha string, err error) {
-	cmd := Command(gitDir, "git", "rev-parse", ref)
-	cmd.Stdout = nil // for cmd.Output
+	return RevParseContext(context.Background(), gitDir, ref, DefaultTimeouts)
+}
 
-	var stdout []byte
-	stdout, err = cmd.Output()
+// ListRefsContext lists every ref in gitDir by its full name (e.g.
+// "refs/heads/main"), bounded by timeouts.LsTree since it's a similarly
+// cheap, local metadata read.
+func ListRefsContext(ctx context.Context, gitDir string, timeouts Timeouts) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.LsTree)
+	defer cancel()
+
+	out, err := gitOutput(ctx, gitDir, []string{"for-each-ref", "--format=%(refname)"}, nil, GitEnv{})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	sha = strings.TrimSpace(string(stdout))
-	return sha, nil
+	trimmed := strings.TrimRight(string(out), "\n")
+	if trimmed == "" {
+		return nil, nil
+	}
+	return strings.Split(trimmed, "\n"), nil
 }
 
-// Describe describes a commit given a reference using the most recent tag
-// reachable from it.
-func Describe(gitDir, ref string) (desc string, err error) {
-	cmd := Command(gitDir, "git", "describe", "--all", "--tags", "--long", ref)
-	cmd.Stdout = nil // for cmd.Output
+// DescribeContext describes a commit given a reference using the most
+// recent tag reachable from it, bounded by timeouts.RevParse (it's as cheap
+// a metadata read as rev-parse, so it shares the same budget).
+func DescribeContext(ctx context.Context, gitDir, ref string, timeouts Timeouts) (desc string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.RevParse)
+	defer cancel()
 
-	var stdout []byte
-	stdout, err = cmd.Output()
+	out, err := gitOutput(ctx, gitDir, []string{"describe", "--all", "--tags", "--long", ref}, nil, GitEnv{})
 	if err != nil {
 		return "", err
 	}
 
-	desc = strings.TrimSpace(string(stdout))
+	desc = strings.TrimSpace(string(out))
 	desc = strings.TrimPrefix(desc, "heads/")
 	desc = strings.TrimPrefix(desc, "tags/")
 	return desc, nil
 }
 
-// RecursiveCheckout recursively checks out repositories; similar to "git clone
-// --recursive".
-func RecursiveCheckout(gitDir, checkoutPath, rev string, timeout time.Duration, messages io.Writer) error {
-	err := Checkout(gitDir, checkoutPath, rev)
+// Describe is the Context-less form of DescribeContext, using
+// DefaultTimeouts.
+func Describe(gitDir, ref string) (desc string, err error) {
+	return DescribeContext(context.Background(), gitDir, ref, DefaultTimeouts)
+}
+
+// RecursiveCheckoutContext recursively checks out repositories; similar to
+// "git clone --recursive".
+func RecursiveCheckoutContext(ctx context.Context, gitDir, checkoutPath, rev string, messages io.Writer, opts CloneOptions, env GitEnv, timeouts Timeouts) error {
+	err := CheckoutContext(ctx, gitDir, checkoutPath, rev, opts, env, timeouts)
 	if err != nil {
 		return fmt.Errorf("failed to checkout: %v", err)
 	}
 
-	err = PrepSubmodules(gitDir, checkoutPath, rev, timeout, messages)
+	err = PrepSubmodulesContext(ctx, gitDir, checkoutPath, rev, messages, opts, env, timeouts)
 	if err != nil {
 		return fmt.Errorf("failed to prep submodules: %v", err)
 	}
 	return nil
 }
 
-// Command invokes a `command` in `workdir` with `args`, connecting Stdout and
-// Stderr to Stderr.
-func Command(workdir, command string, args ...string) *exec.Cmd {
+// RecursiveCheckout is the Context-less form of RecursiveCheckoutContext,
+// applying timeout uniformly to every step.
+func RecursiveCheckout(gitDir, checkoutPath, rev string, timeout time.Duration, messages io.Writer, opts CloneOptions, env GitEnv) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return RecursiveCheckoutContext(ctx, gitDir, checkoutPath, rev, messages, opts, env, UniformTimeouts(timeout))
+}
+
+// Command invokes `command` in `workdir` with `args`, connecting Stdout and
+// Stderr to Stderr. When command is "git", env's proxy, SSH and credential
+// settings are applied as `-c key=value` flags ahead of args, and (for
+// NoProxy) as extra environment variables; see GitEnv.
+func Command(workdir string, env GitEnv, command string, args ...string) *exec.Cmd {
 	// log.Printf("wd = %s cmd = %s, args = %q", workdir, command, append([]string{}, args...))
+	if command == "git" {
+		args = append(env.configArgs(), args...)
+	}
 	cmd := exec.Command(command, args...)
 	cmd.Dir = workdir
 	cmd.Stdout = os.Stderr
 	cmd.Stderr = os.Stderr
+	if environ := env.environ(); environ != nil {
+		cmd.Env = environ
+	}
 	return cmd
 }
 
@@ -0,0 +1,160 @@
+package git
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// runGit runs git(args...) in dir, failing the test on error. It's used to
+// build fixture repos directly with the real git binary, independent of the
+// package functions under test.
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+	return string(out)
+}
+
+// newSourceRepo creates a non-bare repo at a fresh temp dir with commits,
+// each touching a different file, one second apart so commit times are
+// distinguishable.
+func newSourceRepo(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	runGit(t, dir, "init", "-q", "-b", "master")
+
+	commit := func(name, content string, when time.Time) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		runGit(t, dir, "add", name)
+		cmd := exec.Command("git", "commit", "-q", "-m", "add "+name)
+		cmd.Dir = dir
+		date := when.Format(time.RFC3339)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+			"GIT_AUTHOR_DATE="+date, "GIT_COMMITTER_DATE="+date,
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git commit: %v\n%s", err, out)
+		}
+	}
+
+	base := time.Unix(1700000000, 0).UTC()
+	commit("a", "a1", base)
+	commit("b", "b1", base.Add(1*time.Hour))
+	commit("a", "a2", base.Add(2*time.Hour))
+	return dir
+}
+
+func TestCloneOptionsArgs(t *testing.T) {
+	cases := []struct {
+		name string
+		opts CloneOptions
+		want []string
+	}{
+		{name: "zero value", opts: CloneOptions{}, want: nil},
+		{name: "depth", opts: CloneOptions{Depth: 1}, want: []string{"--depth", "1"}},
+		{name: "filter", opts: CloneOptions{Filter: "blob:none"}, want: []string{"--filter=blob:none"}},
+		{name: "single branch", opts: CloneOptions{SingleBranch: true}, want: []string{"--single-branch"}},
+		{
+			name: "combined",
+			opts: CloneOptions{Depth: 1, Filter: "blob:none", SingleBranch: true},
+			want: []string{"--depth", "1", "--filter=blob:none", "--single-branch"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := c.opts.args()
+			if len(got) != len(c.want) {
+				t.Fatalf("args() = %q, want %q", got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Errorf("args() = %q, want %q", got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestIsShallowAndUnshallow(t *testing.T) {
+	ctx := context.Background()
+	src := newSourceRepo(t)
+
+	mirror := filepath.Join(t.TempDir(), "mirror.git")
+	// git ignores --depth for local clones unless given a file:// URL.
+	runGit(t, ".", "clone", "-q", "--mirror", "--depth", "1", "file://"+src, mirror)
+
+	shallow, err := IsShallow(ctx, mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !shallow {
+		t.Fatal("IsShallow() = false for a --depth 1 clone, want true")
+	}
+
+	if err := Unshallow(ctx, mirror, nil, GitEnv{}); err != nil {
+		t.Fatalf("Unshallow: %v", err)
+	}
+
+	shallow, err = IsShallow(ctx, mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shallow {
+		t.Error("IsShallow() = true after Unshallow, want false")
+	}
+}
+
+func TestIsShallowFalseForFullClone(t *testing.T) {
+	ctx := context.Background()
+	src := newSourceRepo(t)
+
+	mirror := filepath.Join(t.TempDir(), "mirror.git")
+	runGit(t, ".", "clone", "-q", "--mirror", src, mirror)
+
+	shallow, err := IsShallow(ctx, mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shallow {
+		t.Error("IsShallow() = true for a full clone, want false")
+	}
+}
+
+func TestListRefsContext(t *testing.T) {
+	ctx := context.Background()
+	src := newSourceRepo(t)
+	runGit(t, src, "tag", "v1.0")
+
+	refs, err := ListRefsContext(ctx, src, DefaultTimeouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{"refs/heads/master": true, "refs/tags/v1.0": true}
+	got := make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		got[ref] = true
+	}
+	for ref := range want {
+		if !got[ref] {
+			t.Errorf("ListRefsContext() = %q, missing %v", refs, ref)
+		}
+	}
+}
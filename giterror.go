@@ -0,0 +1,101 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// GitError reports a failed git invocation, carrying enough detail that
+// callers can inspect git's own diagnostics programmatically instead of
+// string-matching messages like "exit status 1".
+type GitError struct {
+	Args     []string // the full command line, including "git" itself
+	Dir      string
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Err      error // the underlying *exec.ExitError (or other run error)
+}
+
+func (e *GitError) Error() string {
+	return fmt.Sprintf("%s (in %s): %v: %s",
+		strings.Join(e.Args, " "), e.Dir, e.Err, strings.TrimSpace(e.Stderr))
+}
+
+// Unwrap allows errors.Is/errors.As to see through to the *exec.ExitError.
+func (e *GitError) Unwrap() error { return e.Err }
+
+// Timeouts bounds each kind of git operation independently, so that, for
+// example, a slow submodule fetch can't consume the budget meant for the
+// top-level clone.
+type Timeouts struct {
+	Clone    time.Duration
+	Fetch    time.Duration
+	Checkout time.Duration
+	LsTree   time.Duration
+	RevParse time.Duration
+}
+
+// DefaultTimeouts is a reasonable set of per-operation budgets for the
+// Context-less convenience wrappers that don't take a Timeouts of their own.
+var DefaultTimeouts = Timeouts{
+	Clone:    1 * time.Hour,
+	Fetch:    1 * time.Hour,
+	Checkout: 15 * time.Minute,
+	LsTree:   30 * time.Second,
+	RevParse: 30 * time.Second,
+}
+
+// UniformTimeouts returns a Timeouts that applies d to every operation. It
+// exists so the legacy, single-timeout wrappers (LocalMirror, Checkout, ...)
+// can keep their old signature while delegating to the Context-aware,
+// per-operation API.
+func UniformTimeouts(d time.Duration) Timeouts {
+	return Timeouts{Clone: d, Fetch: d, Checkout: d, LsTree: d, RevParse: d}
+}
+
+// gitOutput runs `git args...` in dir, respecting ctx's deadline and
+// applying env's proxy/SSH/credential settings. It always captures
+// stdout/stderr so a failure can be reported as a *GitError; if messages is
+// non-nil, a live copy is also streamed there, for long-running commands
+// like clone and fetch.
+func gitOutput(ctx context.Context, dir string, args []string, messages io.Writer, env GitEnv) ([]byte, error) {
+	cmd := Command(dir, env, "git", args...)
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+	if messages != nil {
+		cmd.Stdout = io.MultiWriter(messages, &stdoutBuf)
+		cmd.Stderr = io.MultiWriter(messages, &stderrBuf)
+	} else {
+		cmd.Stdout = &stdoutBuf
+		cmd.Stderr = &stderrBuf
+	}
+
+	if err := ContextRun(ctx, cmd); err != nil {
+		return stdoutBuf.Bytes(), &GitError{
+			Args:     append([]string{}, cmd.Args...),
+			Dir:      dir,
+			Stdout:   stdoutBuf.String(),
+			Stderr:   stderrBuf.String(),
+			ExitCode: exitCode(err),
+			Err:      err,
+		}
+	}
+	return stdoutBuf.Bytes(), nil
+}
+
+// exitCode extracts the process exit code from err, or -1 if err didn't come
+// from a process that ran and exited (e.g. it was killed, or never started).
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
@@ -0,0 +1,59 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGitOutputErrorArgsIncludesConfigArgs(t *testing.T) {
+	env := GitEnv{SSHCommand: "ssh -i /keys/deploy"}
+
+	// Not a git repo, so this fails with a *GitError whose Args should
+	// reflect the argv git actually ran, configArgs and all.
+	_, err := gitOutput(context.Background(), t.TempDir(), []string{"rev-parse", "--verify", "HEAD"}, nil, env)
+
+	var gitErr *GitError
+	if !errors.As(err, &gitErr) {
+		t.Fatalf("gitOutput err = %v, want a *GitError", err)
+	}
+
+	want := []string{"git", "-c", "core.sshCommand=ssh -i /keys/deploy", "rev-parse", "--verify", "HEAD"}
+	if !reflect.DeepEqual(gitErr.Args, want) {
+		t.Errorf("GitError.Args = %q, want %q", gitErr.Args, want)
+	}
+}
+
+func TestGitErrorError(t *testing.T) {
+	err := &GitError{
+		Args:     []string{"git", "rev-parse", "HEAD"},
+		Dir:      "/tmp/repo",
+		Stderr:   "fatal: not a git repository\n",
+		ExitCode: 128,
+		Err:      errors.New("exit status 128"),
+	}
+
+	msg := err.Error()
+	for _, want := range []string{"git rev-parse HEAD", "/tmp/repo", "exit status 128", "fatal: not a git repository"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Error() = %q, want it to contain %q", msg, want)
+		}
+	}
+}
+
+func TestUniformTimeouts(t *testing.T) {
+	got := UniformTimeouts(5 * time.Second)
+	want := Timeouts{
+		Clone:    5 * time.Second,
+		Fetch:    5 * time.Second,
+		Checkout: 5 * time.Second,
+		LsTree:   5 * time.Second,
+		RevParse: 5 * time.Second,
+	}
+	if got != want {
+		t.Errorf("UniformTimeouts(5s) = %+v, want %+v", got, want)
+	}
+}
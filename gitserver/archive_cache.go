@@ -0,0 +1,175 @@
+package gitserver
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// archiveCache is an LRU of tarballs already built on disk, keyed by the sha
+// of the commit they were built from. It exists so that repeated requests
+// for the same ref (which usually resolves to the same sha) don't repeat the
+// work of checking out a worktree and taring it up.
+type archiveCache struct {
+	dir      string
+	maxItems int
+
+	mu        sync.Mutex
+	order     *list.List // most-recently-used at the front
+	entries   map[string]*list.Element
+	lingering map[*archiveCacheEntry]struct{} // evicted but still being read; see release
+
+	// building tracks an archive build in progress for a given key, so that
+	// concurrent requests resolving to the same not-yet-cached sha wait for
+	// one build instead of racing each other to write the same tar file.
+	building map[string]*buildInFlight
+}
+
+type buildInFlight struct {
+	done chan struct{}
+	err  error
+}
+
+// archiveCacheEntry tracks refs, the number of callers currently reading
+// path, so that a concurrent eviction can't unlink the file out from under
+// an in-progress response: eviction only deletes immediately if refs is 0,
+// otherwise it marks the entry evicted and hands it to lingering for
+// release to clean up once the last reader is done.
+type archiveCacheEntry struct {
+	key     string
+	path    string
+	refs    int
+	evicted bool
+}
+
+// newArchiveCache creates an LRU that stores at most maxItems tarballs under
+// dir.
+func newArchiveCache(dir string, maxItems int) (*archiveCache, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, fmt.Errorf("newArchiveCache: %v", err)
+	}
+	return &archiveCache{
+		dir:       dir,
+		maxItems:  maxItems,
+		order:     list.New(),
+		entries:   make(map[string]*list.Element),
+		lingering: make(map[*archiveCacheEntry]struct{}),
+		building:  make(map[string]*buildInFlight),
+	}, nil
+}
+
+// path returns the on-disk path for sha's archive, a reference to pass to
+// release, and whether the archive already exists in the cache, marking it
+// as most-recently-used if so. A hit takes a read reference on the entry,
+// which the caller must release exactly once (via release) when it's done
+// reading the file, so a concurrent add can't evict and unlink the archive
+// while this caller still has it open.
+func (c *archiveCache) path(repo, sha string) (string, *archiveCacheEntry, bool) {
+	key := repo + "/" + sha
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		entry := elem.Value.(*archiveCacheEntry)
+		entry.refs++
+		return entry.path, entry, true
+	}
+	return filepath.Join(c.dir, repo, sha+".tar"), nil, false
+}
+
+// cached reports whether repo/sha's archive is already in the cache,
+// without taking a read reference. It exists only so buildOnce's callback
+// can skip a redundant rebuild; actually reading the file still requires a
+// call to path to acquire a reference.
+func (c *archiveCache) cached(repo, sha string) bool {
+	key := repo + "/" + sha
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.entries[key]
+	return ok
+}
+
+// release drops a read reference taken by a hit from path, deleting the
+// on-disk archive if it was evicted while still in use. It operates on the
+// exact entry path returned, not a fresh lookup by key, so a rebuild that
+// reuses the same repo/sha key while the old entry is still lingering can't
+// have its refcount corrupted by a release meant for the old entry.
+func (c *archiveCache) release(entry *archiveCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.refs--
+	if entry.evicted && entry.refs <= 0 {
+		delete(c.lingering, entry)
+		os.Remove(entry.path)
+	}
+}
+
+// buildOnce runs build to produce repo/sha's archive, but if a build for the
+// same key is already in progress, waits for it and returns its result
+// instead of starting a second one. This is what keeps two concurrent
+// requests for the same not-yet-cached sha from both calling buildArchive
+// against the same destination path at once.
+func (c *archiveCache) buildOnce(repo, sha string, build func() error) error {
+	key := repo + "/" + sha
+
+	c.mu.Lock()
+	if b, ok := c.building[key]; ok {
+		c.mu.Unlock()
+		<-b.done
+		return b.err
+	}
+
+	b := &buildInFlight{done: make(chan struct{})}
+	c.building[key] = b
+	c.mu.Unlock()
+
+	b.err = build()
+	close(b.done)
+
+	c.mu.Lock()
+	delete(c.building, key)
+	c.mu.Unlock()
+
+	return b.err
+}
+
+// add records that sha's archive now exists at its cache path, evicting the
+// least-recently-used entry if the cache is over capacity. An evicted entry
+// still being read (refs > 0) is handed to lingering instead of having its
+// file removed immediately; release deletes it once the last reader is done.
+func (c *archiveCache) add(repo, sha string) {
+	key := repo + "/" + sha
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+
+	entry := &archiveCacheEntry{key: key, path: filepath.Join(c.dir, repo, sha+".tar")}
+	c.entries[key] = c.order.PushFront(entry)
+
+	for c.order.Len() > c.maxItems {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		old := oldest.Value.(*archiveCacheEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, old.key)
+		if old.refs > 0 {
+			old.evicted = true
+			c.lingering[old] = struct{}{}
+		} else {
+			os.Remove(old.path)
+		}
+	}
+}
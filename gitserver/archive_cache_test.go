@@ -0,0 +1,177 @@
+package gitserver
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestArchiveCacheBuildOnceDedupesConcurrentBuilds(t *testing.T) {
+	c, err := newArchiveCache(t.TempDir(), 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var builds int32
+	// release gates the one build that actually runs, so the other 9
+	// callers are guaranteed to find it still in flight rather than racing
+	// ahead and each starting (and finishing) their own before the others
+	// even call buildOnce.
+	release := make(chan struct{})
+	build := func() error {
+		atomic.AddInt32(&builds, 1)
+		<-release
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]error, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = c.buildOnce("repo", "deadbeef", build)
+		}(i)
+	}
+
+	// Give every goroutine a chance to reach buildOnce and queue up behind
+	// whichever of them became the builder before letting that one finish.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&builds); got != 1 {
+		t.Errorf("build ran %d times, want exactly 1", got)
+	}
+	for i, err := range results {
+		if err != nil {
+			t.Errorf("buildOnce caller %d: %v", i, err)
+		}
+	}
+}
+
+func TestArchiveCacheBuildOnceDistinctKeysRunIndependently(t *testing.T) {
+	c, err := newArchiveCache(t.TempDir(), 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var builds int32
+	build := func() error {
+		atomic.AddInt32(&builds, 1)
+		return nil
+	}
+
+	if err := c.buildOnce("repo", "sha1", build); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.buildOnce("repo", "sha2", build); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := atomic.LoadInt32(&builds); got != 2 {
+		t.Errorf("build ran %d times for distinct keys, want 2", got)
+	}
+}
+
+func TestArchiveCacheBuildOncePropagatesAndClearsError(t *testing.T) {
+	c, err := newArchiveCache(t.TempDir(), 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantErr := errors.New("boom")
+	if got := c.buildOnce("repo", "deadbeef", func() error { return wantErr }); got != wantErr {
+		t.Errorf("buildOnce() = %v, want %v", got, wantErr)
+	}
+
+	// A failed build must not wedge the key: a later call has to retry, not
+	// hang waiting on a build that already finished.
+	var ranAgain bool
+	if err := c.buildOnce("repo", "deadbeef", func() error {
+		ranAgain = true
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !ranAgain {
+		t.Error("buildOnce() did not retry after a prior failed build")
+	}
+}
+
+func TestArchiveCacheKeepsFileOnDiskUntilReaderReleases(t *testing.T) {
+	c, err := newArchiveCache(t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.add("repo", "sha1")
+	path, entry, hit := c.path("repo", "sha1")
+	if !hit {
+		t.Fatal("path() = miss right after add(), want hit")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("tar bytes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Adding a second entry evicts sha1 (maxItems is 1), but it's still
+	// referenced by the path() call above, so its file must survive.
+	c.add("repo", "sha2")
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("sha1's archive was removed while still referenced: %v", err)
+	}
+
+	c.release(entry)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("sha1's archive still exists after its last reader released, err=%v", err)
+	}
+}
+
+func TestArchiveCacheReleaseDoesNotCorruptRebuiltEntryWithSameKey(t *testing.T) {
+	c, err := newArchiveCache(t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.add("repo", "sha1")
+	path, oldEntry, hit := c.path("repo", "sha1")
+	if !hit {
+		t.Fatal("path() = miss right after add(), want hit")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("tar bytes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Evict sha1 while oldEntry is still referenced, then rebuild it under
+	// the same repo/sha key, as a slow reader streaming the old archive and
+	// a later request rebuilding it after eviction would race to do.
+	c.add("repo", "sha2")
+	c.add("repo", "sha1")
+	_, newEntry, hit := c.path("repo", "sha1")
+	if !hit {
+		t.Fatal("path() = miss after rebuilding sha1, want hit")
+	}
+	if newEntry == oldEntry {
+		t.Fatal("rebuilt entry is the same object as the evicted one, test is not exercising the key collision")
+	}
+
+	// Releasing the stale reference must touch oldEntry, not steal a
+	// reference from newEntry.
+	c.release(oldEntry)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("sha1's original archive still exists after its last reader released, err=%v", err)
+	}
+	if newEntry.refs != 1 {
+		t.Errorf("newEntry.refs = %d after releasing the unrelated old entry, want 1 (untouched)", newEntry.refs)
+	}
+}
@@ -0,0 +1,52 @@
+package gitserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	git "github.com/sensiblecodeio/git-prep-directory"
+)
+
+// RepoConfig describes a single repository to mirror and serve. Env lets a
+// private or proxy-gated repo carry its own proxy/SSH/credential settings,
+// since different mirrored repos may need different ones. Refs, if
+// non-empty, restricts /tar, /sha and /refs to that allow-list (matched
+// against either a ref's full name, e.g. "refs/heads/main", or its short
+// form, e.g. "main"); an empty Refs serves any ref in the mirror, as before.
+type RepoConfig struct {
+	Name string     `json:"name"`
+	URL  string     `json:"url"`
+	Refs []string   `json:"refs"`
+	Env  git.GitEnv `json:"env"`
+}
+
+// Config is the top level configuration for a Server: the list of
+// repositories it should mirror and serve archives for.
+type Config struct {
+	Repos []RepoConfig `json:"repos"`
+}
+
+// LoadConfig reads and parses a JSON config file listing the repositories a
+// Server should serve.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadConfig: %v", err)
+	}
+	defer f.Close()
+
+	var cfg Config
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("LoadConfig: decode %v: %v", path, err)
+	}
+	for i, repo := range cfg.Repos {
+		if repo.Name == "" {
+			return nil, fmt.Errorf("LoadConfig: repo %d missing name", i)
+		}
+		if repo.URL == "" {
+			return nil, fmt.Errorf("LoadConfig: repo %q missing url", repo.Name)
+		}
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,410 @@
+// Package gitserver turns the mirror cache maintained by the git package into
+// a long-running HTTP service: it keeps a LocalMirror per configured repo
+// fresh in the background and serves tarballs, resolved shas and ref lists
+// over HTTP, so build systems can fetch a build context without shelling out
+// to git themselves.
+package gitserver
+
+import (
+	"archive/tar"
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	git "github.com/sensiblecodeio/git-prep-directory"
+)
+
+var (
+	tarRequests  = expvar.NewInt("gitserver_tar_requests")
+	tarCacheHits = expvar.NewInt("gitserver_tar_cache_hits")
+	pollErrors   = expvar.NewInt("gitserver_poll_errors")
+)
+
+// repoMirror is a single repository's LocalMirror plus the lock that keeps
+// background fetches from colliding with in-flight archive reads.
+type repoMirror struct {
+	name   string
+	url    string
+	gitDir string
+	env    git.GitEnv
+	refs   []string // allow-list from RepoConfig.Refs; empty means "any ref"
+
+	// mu guards against a fetch truncating refs that an archive/sha/refs
+	// request is in the middle of reading. Fetches take the write lock;
+	// reads take the read lock.
+	mu sync.RWMutex
+}
+
+// refIsSafe reports whether ref is safe to pass through to git as a raw
+// argv element. A ref beginning with "-" would otherwise be parsed as a
+// flag by the underlying rev-parse/checkout (e.g. "--absolute-git-dir"
+// leaks the mirror cache's on-disk path) rather than looked up as a ref,
+// which refAllowed's allow-list can't be relied on to catch since it's
+// optional and empty (permit-any-ref) by default.
+func refIsSafe(ref string) bool {
+	return ref != "" && !strings.HasPrefix(ref, "-")
+}
+
+// refAllowed reports whether ref may be served for repo, matching either
+// ref's full name (e.g. "refs/heads/main") or its short form (e.g. "main")
+// against repo.refs. An empty repo.refs allows any ref.
+func (repo *repoMirror) refAllowed(ref string) bool {
+	if len(repo.refs) == 0 {
+		return true
+	}
+	short := strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/tags/")
+	for _, allowed := range repo.refs {
+		allowedShort := strings.TrimPrefix(strings.TrimPrefix(allowed, "refs/heads/"), "refs/tags/")
+		if allowed == ref || allowedShort == short {
+			return true
+		}
+	}
+	return false
+}
+
+// Server maintains a LocalMirror per configured repo, refreshes them on a
+// timer, and exposes them over HTTP.
+type Server struct {
+	mirrorRoot string
+	poll       time.Duration
+	timeouts   git.Timeouts
+
+	repos    map[string]*repoMirror
+	archives *archiveCache
+}
+
+// NewServer builds a Server for cfg. Mirrors are stored under mirrorRoot and
+// each repo is re-fetched every poll interval. timeouts bounds every git
+// invocation the server makes (mirroring, archive checkouts, ref/sha
+// lookups) and is unrelated to poll: poll only paces how often a repo is
+// re-fetched, it is not a budget for how long any single fetch may take.
+// Call Start to begin polling and Handler to get the http.Handler to serve.
+func NewServer(cfg *Config, mirrorRoot string, poll time.Duration, timeouts git.Timeouts) (*Server, error) {
+	// mirrorRoot is used as a git --work-tree, which a subprocess resolves
+	// relative to its own cmd.Dir (a repo's gitDir), not this process's
+	// cwd; a relative mirrorRoot would then resolve to the wrong place.
+	// Pin it down to an absolute path once, here, so every later use is
+	// unambiguous regardless of what a caller passed in.
+	mirrorRoot, err := filepath.Abs(mirrorRoot)
+	if err != nil {
+		return nil, fmt.Errorf("NewServer: %v", err)
+	}
+
+	s := &Server{
+		mirrorRoot: mirrorRoot,
+		poll:       poll,
+		timeouts:   timeouts,
+		repos:      make(map[string]*repoMirror, len(cfg.Repos)),
+	}
+
+	archives, err := newArchiveCache(filepath.Join(mirrorRoot, "archives"), 128)
+	if err != nil {
+		return nil, err
+	}
+	s.archives = archives
+
+	for _, repo := range cfg.Repos {
+		s.repos[repo.Name] = &repoMirror{
+			name:   repo.Name,
+			url:    repo.URL,
+			gitDir: filepath.Join(mirrorRoot, "mirrors", repo.Name),
+			env:    repo.Env,
+			refs:   repo.Refs,
+		}
+	}
+	return s, nil
+}
+
+// Start runs an accessibility preflight check against every configured
+// repo, then fetches each once and spawns a goroutine per repo that
+// re-fetches it every poll interval, until ctx is cancelled.
+func (s *Server) Start(ctx context.Context) error {
+	for _, repo := range s.repos {
+		if !git.IsRepoURLAccessible(ctx, repo.url, repo.env) {
+			log.Printf("gitserver: warning: %v (%v) failed the accessibility preflight check", repo.name, repo.url)
+		}
+	}
+
+	for _, repo := range s.repos {
+		if err := s.refresh(ctx, repo); err != nil {
+			return fmt.Errorf("initial mirror of %v: %v", repo.name, err)
+		}
+	}
+
+	for _, repo := range s.repos {
+		go s.pollLoop(ctx, repo)
+	}
+	return nil
+}
+
+func (s *Server) pollLoop(ctx context.Context, repo *repoMirror) {
+	ticker := time.NewTicker(s.poll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.refresh(ctx, repo); err != nil {
+				pollErrors.Add(1)
+				log.Printf("gitserver: polling %v: %v", repo.name, err)
+			}
+		}
+	}
+}
+
+// refresh fetches the latest refs for repo, taking the write lock so no
+// archive or sha request reads a half-updated mirror. The clone/fetch
+// itself is bounded by s.timeouts, not by the poll interval: the two are
+// unrelated, and a mirror whose first clone takes longer than one poll
+// tick must not be killed by the next tick coming around.
+func (s *Server) refresh(ctx context.Context, repo *repoMirror) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(repo.gitDir), 0777); err != nil {
+		return err
+	}
+	return git.LocalMirrorContext(ctx, repo.url, repo.gitDir, "HEAD", os.Stderr, git.CloneOptions{}, repo.env, s.timeouts)
+}
+
+// Handler returns the http.Handler serving the tarball API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tar/{repo}/{ref}", s.handleTar)
+	mux.HandleFunc("GET /sha/{repo}/{ref}", s.handleSha)
+	mux.HandleFunc("GET /refs/{repo}", s.handleRefs)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+func (s *Server) repo(name string) (*repoMirror, bool) {
+	repo, ok := s.repos[name]
+	return repo, ok
+}
+
+func (s *Server) handleTar(w http.ResponseWriter, r *http.Request) {
+	tarRequests.Add(1)
+
+	repo, ok := s.repo(r.PathValue("repo"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	ref := r.PathValue("ref")
+	if !refIsSafe(ref) {
+		http.Error(w, fmt.Sprintf("invalid ref %q", ref), http.StatusBadRequest)
+		return
+	}
+	if !repo.refAllowed(ref) {
+		http.Error(w, fmt.Sprintf("ref %v is not in the allow-list for %v", ref, repo.name), http.StatusForbidden)
+		return
+	}
+
+	repo.mu.RLock()
+	sha, err := git.RevParseContext(r.Context(), repo.gitDir, ref, s.timeouts)
+	repo.mu.RUnlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("resolving %v: %v", ref, err), http.StatusNotFound)
+		return
+	}
+
+	path, entry, hit := s.archives.path(repo.name, sha)
+	if hit {
+		tarCacheHits.Add(1)
+	} else {
+		err := s.archives.buildOnce(repo.name, sha, func() error {
+			// Another goroutine may have just finished building this exact
+			// archive while we were waiting to enter buildOnce. cached, not
+			// path, since we're not about to read the file here — taking a
+			// read reference is the caller's job, below, once this returns.
+			if s.archives.cached(repo.name, sha) {
+				return nil
+			}
+			// buildArchive runs against context.Background(), not the
+			// request's context: buildOnce may be sharing this build with
+			// other requests, so it must not be cancelled just because the
+			// request that happened to trigger it disconnects.
+			if err := s.buildArchive(repo, sha, path); err != nil {
+				return err
+			}
+			s.archives.add(repo.name, sha)
+			return nil
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("building archive: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// The archive is now guaranteed to exist; acquire a read reference
+		// on it so a concurrent eviction can't unlink it from under the
+		// os.Open below.
+		path, entry, hit = s.archives.path(repo.name, sha)
+		if !hit {
+			http.Error(w, "archive vanished right after being built", http.StatusInternalServerError)
+			return
+		}
+	}
+	defer s.archives.release(entry)
+
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	io.Copy(w, f)
+}
+
+// buildArchive checks out sha into a temporary worktree (which sets file
+// mtimes to their commit times via SetMTimes) and tars the result up to
+// destPath.
+func (s *Server) buildArchive(repo *repoMirror, sha, destPath string) error {
+	checkoutDir, err := os.MkdirTemp(s.mirrorRoot, "archive-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(checkoutDir)
+
+	repo.mu.RLock()
+	err = git.CheckoutContext(context.Background(), repo.gitDir, checkoutDir, sha, git.CloneOptions{}, repo.env, s.timeouts)
+	repo.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("checkout: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0777); err != nil {
+		return err
+	}
+
+	tmpDest := destPath + ".tmp"
+	out, err := os.Create(tmpDest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := tarDirectory(out, checkoutDir); err != nil {
+		return fmt.Errorf("tarDirectory: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpDest, destPath)
+}
+
+// tarDirectory writes the contents of dir to w as a tar stream, preserving
+// the mtimes already set on each file (see buildArchive). Symlinks (common
+// in a git checkout, and sometimes dangling) are written as TypeSymlink
+// entries pointing at their target rather than followed, since following
+// one would copy in the wrong bytes (or fail outright if it's dangling).
+func tarDirectory(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			header, err := tar.FileInfoHeader(info, target)
+			if err != nil {
+				return err
+			}
+			header.Name = rel
+			return tw.WriteHeader(header)
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = rel
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+func (s *Server) handleSha(w http.ResponseWriter, r *http.Request) {
+	repo, ok := s.repo(r.PathValue("repo"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	ref := r.PathValue("ref")
+	if !refIsSafe(ref) {
+		http.Error(w, fmt.Sprintf("invalid ref %q", ref), http.StatusBadRequest)
+		return
+	}
+	if !repo.refAllowed(ref) {
+		http.Error(w, fmt.Sprintf("ref %v is not in the allow-list for %v", ref, repo.name), http.StatusForbidden)
+		return
+	}
+
+	repo.mu.RLock()
+	sha, err := git.RevParseContext(r.Context(), repo.gitDir, ref, s.timeouts)
+	repo.mu.RUnlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	fmt.Fprintln(w, sha)
+}
+
+func (s *Server) handleRefs(w http.ResponseWriter, r *http.Request) {
+	repo, ok := s.repo(r.PathValue("repo"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	repo.mu.RLock()
+	refs, err := git.ListRefsContext(r.Context(), repo.gitDir, s.timeouts)
+	repo.mu.RUnlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, ref := range refs {
+		if repo.refAllowed(ref) {
+			fmt.Fprintln(w, ref)
+		}
+	}
+}
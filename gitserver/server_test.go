@@ -0,0 +1,109 @@
+package gitserver
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRefAllowed(t *testing.T) {
+	cases := []struct {
+		name string
+		refs []string
+		ref  string
+		want bool
+	}{
+		{name: "empty allow-list allows anything", refs: nil, ref: "refs/heads/main", want: true},
+		{name: "full form matches full form", refs: []string{"refs/heads/main"}, ref: "refs/heads/main", want: true},
+		{name: "short entry matches full ref", refs: []string{"main"}, ref: "refs/heads/main", want: true},
+		{name: "full entry matches short ref", refs: []string{"refs/heads/main"}, ref: "main", want: true},
+		{name: "short entry matches short ref", refs: []string{"main"}, ref: "main", want: true},
+		{name: "tag form matches", refs: []string{"refs/tags/v1.0"}, ref: "v1.0", want: true},
+		{name: "not in allow-list is denied", refs: []string{"main"}, ref: "dev", want: false},
+		{name: "unrelated full ref is denied", refs: []string{"refs/heads/main"}, ref: "refs/heads/dev", want: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			repo := &repoMirror{refs: c.refs}
+			if got := repo.refAllowed(c.ref); got != c.want {
+				t.Errorf("refAllowed(%q) with refs=%q = %v, want %v", c.ref, c.refs, got, c.want)
+			}
+		})
+	}
+}
+
+func TestRefIsSafe(t *testing.T) {
+	cases := []struct {
+		ref  string
+		want bool
+	}{
+		{ref: "main", want: true},
+		{ref: "refs/heads/main", want: true},
+		{ref: "deadbeef", want: true},
+		{ref: "", want: false},
+		{ref: "--absolute-git-dir", want: false},
+		{ref: "-x", want: false},
+	}
+
+	for _, c := range cases {
+		if got := refIsSafe(c.ref); got != c.want {
+			t.Errorf("refIsSafe(%q) = %v, want %v", c.ref, got, c.want)
+		}
+	}
+}
+
+func TestTarDirectoryPreservesSymlinks(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "real"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("real", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("missing", filepath.Join(dir, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := tarDirectory(&buf, dir); err != nil {
+		t.Fatalf("tarDirectory: %v", err)
+	}
+
+	type entry struct {
+		typeflag byte
+		linkname string
+		data     string
+	}
+	got := make(map[string]entry)
+
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading tar: %v", err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = entry{typeflag: hdr.Typeflag, linkname: hdr.Linkname, data: string(data)}
+	}
+
+	if e, ok := got["real"]; !ok || e.typeflag != tar.TypeReg || e.data != "hello" {
+		t.Errorf("real = %+v, ok=%v, want a regular file containing %q", e, ok, "hello")
+	}
+	if e, ok := got["link"]; !ok || e.typeflag != tar.TypeSymlink || e.linkname != "real" {
+		t.Errorf("link = %+v, ok=%v, want a symlink to %q", e, ok, "real")
+	}
+	if e, ok := got["dangling"]; !ok || e.typeflag != tar.TypeSymlink || e.linkname != "missing" {
+		t.Errorf("dangling = %+v, ok=%v, want a symlink to %q (not followed)", e, ok, "missing")
+	}
+}
@@ -0,0 +1,54 @@
+package git
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ParseGitRef splits a single "url#ref:subdir" argument into its three
+// parts, mirroring the convention Docker's build context documentation
+// established, so callers can write
+//
+//	git@example.com:foo/bar.git#v1.2.3:services/api
+//
+// instead of passing url, ref and subdir as separate flags. Both "#ref" and
+// ":subdir" are optional; url is always returned, and ref/subdir are empty
+// if not present in spec.
+//
+// The "#" is located first and everything after it is scanned for ":", so
+// scp-like URLs such as "git@host:path.git" (which contain a ":" of their
+// own, before any "#") are parsed correctly.
+func ParseGitRef(spec string) (url, ref, subdir string, err error) {
+	url = spec
+
+	i := strings.IndexByte(spec, '#')
+	if i < 0 {
+		return url, "", "", nil
+	}
+	url = spec[:i]
+
+	rest := spec[i+1:]
+	ref = rest
+	if j := strings.IndexByte(rest, ':'); j >= 0 {
+		ref, subdir = rest[:j], rest[j+1:]
+	}
+
+	if err := validateSubdir(subdir); err != nil {
+		return "", "", "", err
+	}
+	return url, ref, subdir, nil
+}
+
+// validateSubdir rejects a subdir that could escape the checkout it will be
+// joined onto, e.g. "..", "../x" or an absolute path.
+func validateSubdir(subdir string) error {
+	if subdir == "" {
+		return nil
+	}
+	clean := filepath.ToSlash(filepath.Clean(subdir))
+	if clean == ".." || strings.HasPrefix(clean, "../") || filepath.IsAbs(clean) {
+		return fmt.Errorf("subdir %q escapes the checkout", subdir)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package git
+
+import "testing"
+
+func TestParseGitRef(t *testing.T) {
+	cases := []struct {
+		spec             string
+		url, ref, subdir string
+		wantErr          bool
+	}{
+		{spec: "https://example.com/foo/bar.git", url: "https://example.com/foo/bar.git"},
+		{
+			spec: "https://example.com/foo/bar.git#v1.2.3",
+			url:  "https://example.com/foo/bar.git",
+			ref:  "v1.2.3",
+		},
+		{
+			spec:   "git@example.com:foo/bar.git#v1.2.3:services/api",
+			url:    "git@example.com:foo/bar.git",
+			ref:    "v1.2.3",
+			subdir: "services/api",
+		},
+		{
+			spec:    "https://example.com/foo/bar.git#v1.2.3:../../etc",
+			wantErr: true,
+		},
+		{
+			spec:    "https://example.com/foo/bar.git#v1.2.3:..",
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		url, ref, subdir, err := ParseGitRef(c.spec)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("ParseGitRef(%q): expected error, got none", c.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseGitRef(%q): unexpected error: %v", c.spec, err)
+			continue
+		}
+		if url != c.url || ref != c.ref || subdir != c.subdir {
+			t.Errorf("ParseGitRef(%q) = (%q, %q, %q), want (%q, %q, %q)",
+				c.spec, url, ref, subdir, c.url, c.ref, c.subdir)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SetMTimes walks checkoutDir, a checkout of ref from gitDir, and sets each
+// file's mtime (and atime) to the commit time of the most recent commit that
+// touched it. This makes the filesystem usable by mtime-based build caches
+// (e.g. Docker's) without every file appearing to change on every checkout,
+// since `git checkout` otherwise stamps everything with the current time.
+//
+// If gitDir lacks the history to determine per-file commit times (a shallow
+// or partial clone made via opts), every file is instead stamped with the
+// commit time of ref itself, unless opts.PromoteOnMtime is set, in which
+// case the missing history is fetched first (see CloneOptions). env is only
+// consulted for that fetch, since it's the one step here that reaches the
+// remote.
+func SetMTimes(ctx context.Context, gitDir, checkoutDir, ref string, opts CloneOptions, env GitEnv, timeouts Timeouts) error {
+	commitTimes, err := commitTimesFor(ctx, gitDir, ref, opts, env, timeouts)
+	if err != nil {
+		return fmt.Errorf("commitTimesFor: %v", err)
+	}
+
+	return filepath.Walk(checkoutDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(checkoutDir, path)
+		if err != nil {
+			return err
+		}
+
+		t, ok := commitTimes.lookup(filepath.ToSlash(rel))
+		if !ok {
+			// Not tracked at ref (shouldn't happen for a clean checkout).
+			return nil
+		}
+		return Chtimes(path, t, t)
+	})
+}
+
+// mtimeIndex answers what commit time a tracked file should be stamped
+// with. single is set when gitDir's history wasn't deep enough to compute
+// per-file times, in which case every path shares that one time.
+type mtimeIndex struct {
+	perFile map[string]time.Time
+	single  *time.Time
+}
+
+func (idx mtimeIndex) lookup(path string) (time.Time, bool) {
+	if idx.single != nil {
+		return *idx.single, true
+	}
+	t, ok := idx.perFile[path]
+	return t, ok
+}
+
+// commitTimesFor builds the mtimeIndex for ref, falling back to a single
+// commit time (or fetching full history, per opts.PromoteOnMtime) when
+// gitDir is shallow.
+func commitTimesFor(ctx context.Context, gitDir, ref string, opts CloneOptions, env GitEnv, timeouts Timeouts) (mtimeIndex, error) {
+	shallow, err := IsShallow(ctx, gitDir)
+	if err != nil {
+		return mtimeIndex{}, fmt.Errorf("IsShallow: %v", err)
+	}
+
+	if shallow && opts.PromoteOnMtime {
+		fetchCtx, cancel := context.WithTimeout(ctx, timeouts.Fetch)
+		defer cancel()
+		if err := Unshallow(fetchCtx, gitDir, os.Stderr, env); err != nil {
+			return mtimeIndex{}, fmt.Errorf("Unshallow: %v", err)
+		}
+		shallow = false
+	}
+
+	if shallow {
+		t, err := commitTime(ctx, gitDir, ref, timeouts)
+		if err != nil {
+			return mtimeIndex{}, err
+		}
+		return mtimeIndex{single: &t}, nil
+	}
+
+	perFile, err := fileCommitTimes(ctx, gitDir, ref, timeouts)
+	if err != nil {
+		return mtimeIndex{}, fmt.Errorf("fileCommitTimes: %v", err)
+	}
+	return mtimeIndex{perFile: perFile}, nil
+}
+
+// commitTime returns the commit time of ref.
+func commitTime(ctx context.Context, gitDir, ref string, timeouts Timeouts) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.LsTree)
+	defer cancel()
+
+	out, err := gitOutput(ctx, gitDir, []string{"log", "-1", "--format=%ct", ref}, nil, GitEnv{})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	sec, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing commit time %q: %v", out, err)
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// fileCommitTimes returns, for every path known to git at ref, the time of
+// the most recent commit that touched it.
+func fileCommitTimes(ctx context.Context, gitDir, ref string, timeouts Timeouts) (map[string]time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.LsTree)
+	defer cancel()
+
+	out, err := gitOutput(ctx, gitDir, []string{"log", "--name-only", "--no-color", "--format=@@%ct", ref}, nil, GitEnv{})
+	if err != nil {
+		return nil, err
+	}
+
+	times := make(map[string]time.Time)
+
+	var current time.Time
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "@@"):
+			sec, err := strconv.ParseInt(strings.TrimPrefix(line, "@@"), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parsing commit time %q: %v", line, err)
+			}
+			current = time.Unix(sec, 0)
+		default:
+			// Commits are listed newest-first, so the first time we see a
+			// path is its most recent commit.
+			if _, ok := times[line]; !ok {
+				times[line] = current
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return times, nil
+}
@@ -0,0 +1,123 @@
+package git
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMtimeIndexLookup(t *testing.T) {
+	single := time.Unix(1700000000, 0)
+	idxSingle := mtimeIndex{single: &single}
+	if got, ok := idxSingle.lookup("any/path"); !ok || !got.Equal(single) {
+		t.Errorf("single.lookup() = %v, %v, want %v, true", got, ok, single)
+	}
+
+	perFile := map[string]time.Time{"a": time.Unix(1, 0)}
+	idxPerFile := mtimeIndex{perFile: perFile}
+	if got, ok := idxPerFile.lookup("a"); !ok || !got.Equal(perFile["a"]) {
+		t.Errorf("perFile.lookup(\"a\") = %v, %v, want %v, true", got, ok, perFile["a"])
+	}
+	if _, ok := idxPerFile.lookup("missing"); ok {
+		t.Error("perFile.lookup(\"missing\") = true, want false")
+	}
+}
+
+func TestCommitTimesForFullHistory(t *testing.T) {
+	ctx := context.Background()
+	src := newSourceRepo(t)
+
+	mirror := filepath.Join(t.TempDir(), "mirror.git")
+	runGit(t, ".", "clone", "-q", "--mirror", src, mirror)
+
+	idx, err := commitTimesFor(ctx, mirror, "master", CloneOptions{}, GitEnv{}, UniformTimeouts(time.Minute))
+	if err != nil {
+		t.Fatalf("commitTimesFor: %v", err)
+	}
+	if idx.single != nil {
+		t.Fatal("commitTimesFor() returned a single fallback time for a full-history mirror")
+	}
+
+	aTime, ok := idx.lookup("a")
+	if !ok {
+		t.Fatal("commitTimesFor() has no entry for \"a\"")
+	}
+	bTime, ok := idx.lookup("b")
+	if !ok {
+		t.Fatal("commitTimesFor() has no entry for \"b\"")
+	}
+
+	// "a" was last touched by the third commit (base+2h), "b" by the
+	// second (base+1h): each file's time should be its own most recent
+	// commit, not the overall HEAD commit time.
+	if !aTime.After(bTime) {
+		t.Errorf("commit time of \"a\" (%v) should be after \"b\" (%v): \"a\" was touched more recently", aTime, bTime)
+	}
+}
+
+func TestCommitTimesForShallowFallsBackToSingleTime(t *testing.T) {
+	ctx := context.Background()
+	src := newSourceRepo(t)
+
+	mirror := filepath.Join(t.TempDir(), "mirror.git")
+	// git ignores --depth for local clones unless given a file:// URL.
+	runGit(t, ".", "clone", "-q", "--mirror", "--depth", "1", "file://"+src, mirror)
+
+	idx, err := commitTimesFor(ctx, mirror, "master", CloneOptions{}, GitEnv{}, UniformTimeouts(time.Minute))
+	if err != nil {
+		t.Fatalf("commitTimesFor: %v", err)
+	}
+	if idx.single == nil {
+		t.Fatal("commitTimesFor() on a shallow mirror did not fall back to a single commit time")
+	}
+
+	// Every path should share that one time, whether or not it was ever
+	// actually touched by the (missing) history.
+	aTime, ok := idx.lookup("a")
+	if !ok {
+		t.Fatal("commitTimesFor() single fallback has no entry for \"a\"")
+	}
+	otherTime, ok := idx.lookup("does-not-exist")
+	if !ok || !otherTime.Equal(aTime) {
+		t.Errorf("lookup(\"does-not-exist\") = %v, %v, want %v, true (same single time for every path)", otherTime, ok, aTime)
+	}
+}
+
+func TestCommitTimesForPromoteOnMtimeUnshallows(t *testing.T) {
+	ctx := context.Background()
+	src := newSourceRepo(t)
+
+	mirror := filepath.Join(t.TempDir(), "mirror.git")
+	// git ignores --depth for local clones unless given a file:// URL.
+	runGit(t, ".", "clone", "-q", "--mirror", "--depth", "1", "file://"+src, mirror)
+
+	opts := CloneOptions{PromoteOnMtime: true}
+	idx, err := commitTimesFor(ctx, mirror, "master", opts, GitEnv{}, UniformTimeouts(time.Minute))
+	if err != nil {
+		t.Fatalf("commitTimesFor: %v", err)
+	}
+	if idx.single != nil {
+		t.Fatal("commitTimesFor() with PromoteOnMtime still fell back to a single time instead of unshallowing")
+	}
+
+	aTime, ok := idx.lookup("a")
+	if !ok {
+		t.Fatal("commitTimesFor() has no entry for \"a\" after promotion")
+	}
+	bTime, ok := idx.lookup("b")
+	if !ok {
+		t.Fatal("commitTimesFor() has no entry for \"b\" after promotion")
+	}
+	if !aTime.After(bTime) {
+		t.Errorf("commit time of \"a\" (%v) should be after \"b\" (%v) once full history is restored", aTime, bTime)
+	}
+
+	shallow, err := IsShallow(ctx, mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shallow {
+		t.Error("mirror is still shallow after commitTimesFor promoted it")
+	}
+}
@@ -1,6 +1,7 @@
 package git
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -14,9 +15,9 @@ import (
 	ini "github.com/vaughan0/go-ini"
 )
 
-// PrepSubmodules in parallel initializes all submodules and additionally stores
-// them in a local cache.
-func PrepSubmodules(gitDir, checkoutDir, mainRev string, timeout time.Duration, messages io.Writer) error {
+// PrepSubmodulesContext in parallel initializes all submodules and
+// additionally stores them in a local cache.
+func PrepSubmodulesContext(ctx context.Context, gitDir, checkoutDir, mainRev string, messages io.Writer, opts CloneOptions, env GitEnv, timeouts Timeouts) error {
 	gitModules := filepath.Join(checkoutDir, ".gitmodules")
 
 	submodules, err := ParseSubmodules(gitModules)
@@ -30,8 +31,8 @@ func PrepSubmodules(gitDir, checkoutDir, mainRev string, timeout time.Duration,
 
 	log.Printf("Prep %v submodules", len(submodules))
 
-	if err := GetSubmoduleRevs(gitDir, mainRev, submodules); err != nil {
-		return fmt.Errorf("GetSubmoduleRevs: %v", err)
+	if err := GetSubmoduleRevsContext(ctx, gitDir, mainRev, submodules, timeouts); err != nil {
+		return fmt.Errorf("GetSubmoduleRevsContext: %v", err)
 	}
 
 	errs := make(chan error, len(submodules))
@@ -53,7 +54,7 @@ func PrepSubmodules(gitDir, checkoutDir, mainRev string, timeout time.Duration,
 				defer func() { <-semaphore }()
 				semaphore <- struct{}{}
 
-				err := prepSubmodule(gitDir, checkoutDir, submodule, timeout, messages)
+				err := prepSubmoduleContext(ctx, gitDir, checkoutDir, submodule, messages, opts, env, timeouts)
 				if err != nil {
 					err = fmt.Errorf("processing %v: %v", submodule.Path, err)
 				}
@@ -70,6 +71,14 @@ func PrepSubmodules(gitDir, checkoutDir, mainRev string, timeout time.Duration,
 	return nil
 }
 
+// PrepSubmodules is the Context-less form of PrepSubmodulesContext, applying
+// timeout uniformly to every step.
+func PrepSubmodules(gitDir, checkoutDir, mainRev string, timeout time.Duration, messages io.Writer, opts CloneOptions, env GitEnv) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return PrepSubmodulesContext(ctx, gitDir, checkoutDir, mainRev, messages, opts, env, UniformTimeouts(timeout))
+}
+
 // ErrMultiple holds a list of errors.
 type ErrMultiple struct {
 	errs []error
@@ -100,18 +109,18 @@ func MultipleErrors(errs <-chan error) error {
 }
 
 // Checkout the working directory of a given submodule.
-func prepSubmodule(mainGitDir, mainCheckoutDir string, submodule Submodule, timeout time.Duration, messages io.Writer) error {
+func prepSubmoduleContext(ctx context.Context, mainGitDir, mainCheckoutDir string, submodule Submodule, messages io.Writer, opts CloneOptions, env GitEnv, timeouts Timeouts) error {
 	subGitDir := filepath.Join(mainGitDir, "modules", submodule.Path)
 
-	err := LocalMirror(submodule.URL, subGitDir, submodule.Rev, timeout, messages)
+	err := LocalMirrorContext(ctx, submodule.URL, subGitDir, submodule.Rev, messages, opts, env, timeouts)
 	if err != nil {
 		return err
 	}
 
 	subCheckoutPath := filepath.Join(mainCheckoutDir, submodule.Path)
 
-	// Note: checkout may recurse onto prepSubmodules.
-	err = RecursiveCheckout(subGitDir, subCheckoutPath, submodule.Rev, timeout, messages)
+	// Note: checkout may recurse onto prepSubmodulesContext.
+	err = RecursiveCheckoutContext(ctx, subGitDir, subCheckoutPath, submodule.Rev, messages, opts, env, timeouts)
 	if err != nil {
 		return err
 	}
@@ -146,11 +155,11 @@ func ParseSubmodules(filename string) ([]Submodule, error) {
 	return submodules, nil
 }
 
-// GetSubmoduleRevs returns the revisions of all files in a given list of
-// submodules.
-func GetSubmoduleRevs(gitDir, mainRev string, submodules []Submodule) error {
+// GetSubmoduleRevsContext returns the revisions of all files in a given list
+// of submodules.
+func GetSubmoduleRevsContext(ctx context.Context, gitDir, mainRev string, submodules []Submodule, timeouts Timeouts) error {
 	for i := range submodules {
-		rev, err := GetSubmoduleRev(gitDir, submodules[i].Path, mainRev)
+		rev, err := GetSubmoduleRevContext(ctx, gitDir, submodules[i].Path, mainRev, timeouts)
 		if err != nil {
 			return err
 		}
@@ -159,15 +168,16 @@ func GetSubmoduleRevs(gitDir, mainRev string, submodules []Submodule) error {
 	return nil
 }
 
-// GetSubmoduleRev returns the revisions of all files in a given submodule.
-func GetSubmoduleRev(gitDir, submodulePath, mainRev string) (string, error) {
-	cmd := Command(gitDir, "git", "ls-tree", mainRev, "--", submodulePath)
-	cmd.Stdout = nil
+// GetSubmoduleRevContext returns the revisions of all files in a given
+// submodule, bounded by timeouts.LsTree.
+func GetSubmoduleRevContext(ctx context.Context, gitDir, submodulePath, mainRev string, timeouts Timeouts) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.LsTree)
+	defer cancel()
 
-	parts, err := cmd.Output()
+	out, err := gitOutput(ctx, gitDir, []string{"ls-tree", mainRev, "--", submodulePath}, nil, GitEnv{})
 	if err != nil {
 		return "", err
 	}
 
-	return strings.Fields(string(parts))[2], nil
+	return strings.Fields(string(out))[2], nil
 }